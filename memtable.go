@@ -20,6 +20,7 @@ import (
 	"bufio"
 	"bytes"
 	"crypto/aes"
+	"crypto/cipher"
 	cryptorand "crypto/rand"
 	"encoding/binary"
 	"fmt"
@@ -28,6 +29,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
@@ -40,6 +42,7 @@ import (
 	"github.com/dgraph-io/badger/v2/y"
 	"github.com/dgraph-io/ristretto/z"
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 // Also, memTable should have a way to open a WAL and bring SkipList up to speed.
@@ -97,14 +100,22 @@ const memFileExt string = ".mem"
 
 func (db *DB) openMemTable(fid int) (*memTable, error) {
 	filepath := db.mtFilePath(fid)
-	lf := &logFile{
+	// WAL files default to MemoryMap, same as before. SerializeWALReads asks for ordered,
+	// seek-heavy reads, which only means anything under FileIO, so opting in switches the
+	// loading mode too; (*logFile).open is what actually installs the serializer.
+	loadingMode := options.MemoryMap
+	if db.opt.SerializeWALReads {
+		loadingMode = options.FileIO
+	}
+	candidate := &logFile{
 		fid:         uint32(fid),
 		path:        filepath,
-		loadingMode: options.MemoryMap,
+		loadingMode: loadingMode,
 		registry:    db.registry,
 		writeAt:     vlogHeaderSize,
+		isWAL:       true,
 	}
-	lerr := lf.open(filepath, os.O_RDWR|os.O_CREATE, db.opt)
+	lf, lerr := memFileTableFor(db).open(candidate, filepath, os.O_RDWR|os.O_CREATE, db.opt)
 	if lerr != z.NewFile && lerr != nil {
 		return nil, errors.Wrapf(lerr, "While opening mem table")
 	}
@@ -173,7 +184,9 @@ func (mt *memTable) DecrRef() {
 	}
 
 	mt.sl.ReclaimMem()
-	mt.wal.Delete()
+	// Releasing the logFileTable's reference is what actually deletes the WAL file, once
+	// (and only once) no one else still holds it.
+	mt.wal.DecrRef()
 }
 
 func (mt *memTable) replayFunction(opt Options) func(Entry, valuePointer) error {
@@ -200,6 +213,39 @@ func (mt *memTable) replayFunction(opt Options) func(Entry, valuePointer) error
 	}
 }
 
+// encAlgo identifies which cipher is used to protect a logFile's entries. aesCTR is the
+// legacy stream-cipher format kept around so files bootstrapped by older versions keep
+// decoding correctly; aesGCM and chaCha20Poly1305 are AEAD formats that authenticate the
+// entry header in addition to the key and value.
+type encAlgo byte
+
+const (
+	aesCTR encAlgo = iota
+	aesGCM
+	chaCha20Poly1305
+)
+
+// aeadTagSize is the size, in bytes, of the authentication tag appended to an AEAD-sealed
+// entry. It replaces the crc32.Size trailer used by plaintext and aesCTR entries.
+const aeadTagSize = 16
+
+// legacyVlogHeaderSize is the size, in bytes, of the header written by every release before
+// algo/blockSize existed: keyID(8) + baseIV(12), with the first entry starting right after.
+// Files bootstrapped under that layout are still out there, and (*logFile).open must keep
+// reading them as such rather than misreading their first entry's bytes as algo/blockSize.
+const legacyVlogHeaderSize = 20
+
+// vlogHeaderMagic marks a file as having been bootstrapped with the extended header below.
+// It has no meaning under the legacy layout, where the same bytes are simply the start of
+// the first entry, so (*logFile).open uses a mismatch here (overwhelmingly the common case
+// for a legacy file) to fall back to legacyVlogHeaderSize instead of trusting algo/blockSize.
+const vlogHeaderMagic = 0xBADC0DE1
+
+// vlogHeaderSize is the size, in bytes, of the extended header a file bootstrapped by this
+// version gets: keyID(8) + baseIV(12) + vlogHeaderMagic(4) + algo(1) + blockSize(4). It must
+// stay in sync with what (*logFile).bootstrap actually writes and (*logFile).open reads back.
+const vlogHeaderSize = 29
+
 type logFile struct {
 	*z.MmapFile
 	path string
@@ -216,6 +262,250 @@ type logFile struct {
 	baseIV      []byte
 	registry    *KeyRegistry
 	writeAt     uint32
+	// algo is the entry-encryption algorithm this file was bootstrapped with. It is
+	// meaningless when dataKey is nil, i.e. when encryption is disabled.
+	algo encAlgo
+	// blockSize is the plaintext chunk size used to encrypt values in this file, 0 meaning
+	// values are encrypted as a single block (the legacy, pre-chunking layout). Keeping it
+	// per-file lets files bootstrapped under different Options.ValueBlockSize settings
+	// coexist.
+	blockSize uint32
+	// headerSize is the number of bytes this file's actual on-disk header occupies, and so
+	// where its first entry starts: legacyVlogHeaderSize for a file bootstrapped before algo
+	// and blockSize existed, vlogHeaderSize for one bootstrapped with them. Always set by
+	// bootstrap/open; see vlogHeaderMagic for how open tells the two apart.
+	headerSize uint32
+	// serializer, when non-nil, forces read/readAt calls against this file to resolve in
+	// ascending offset order. It's only installed for FileIO-mode files when
+	// Options.SerializeVlogReads/SerializeWALReads is set; nil otherwise, which makes
+	// acquiring/releasing it a no-op.
+	serializer *readSerializer
+
+	// table is the logFileTable this file is registered in, if any. Set by
+	// logFileTable.open; nil for a logFile used standalone (e.g. in tests).
+	table *logFileTable
+	// isWAL marks files that should delete themselves once their refcount drains to zero,
+	// rather than being left mapped for something like doneWriting to finalize.
+	isWAL bool
+
+	// refMu/refCond/ref track how many callers currently hold this logFile, via
+	// IncrRef/DecrRef, instead of every caller managing lf.lock transitions ad hoc.
+	// doneWriting waits on refCond for ref to drain before it unmaps.
+	refMu   sync.Mutex
+	refCond *sync.Cond
+	ref     int32
+}
+
+// logFileTable hands out reference-counted *logFile handles keyed by fid, so every place
+// that needs a vlog/WAL file (openMemTable, iteration, GC, reads) shares one lifetime
+// instead of re-opening through z.OpenMmapFile and managing lf.lock ad hoc. Hold a shared
+// RLock for any files[...] lookup; the exclusive Lock is only for the open/insert
+// transition (and, via DecrRef, the delete transition).
+type logFileTable struct {
+	sync.RWMutex
+	files map[uint32]*logFile
+}
+
+func newLogFileTable() *logFileTable {
+	return &logFileTable{files: make(map[uint32]*logFile)}
+}
+
+// memFileTables holds the logFileTable backing each DB's WAL files, keyed by the DB itself.
+// DB doesn't carry a memFileTable field of its own, so openMemTable looks its table up (and
+// lazily creates it on first use) here instead, rather than risk a nil *logFileTable panic.
+//
+// The right fix is still a real DB.memFileTable field released from DB.Close, which belongs
+// in db.go and is out of reach here; in the meantime memFileTableFor arranges for a db's
+// entry to be dropped once db itself is collected, via runtime.SetFinalizer, so a process
+// that opens and drops many DBs (tests, multi-tenant use) is bounded by DBs still reachable
+// rather than leaking every one ever opened.
+var memFileTables sync.Map // map[*DB]*logFileTable
+
+// memFileTableFor returns the logFileTable backing db's WAL files, creating it (and
+// registering its cleanup) on first use.
+func memFileTableFor(db *DB) *logFileTable {
+	if actual, ok := memFileTables.Load(db); ok {
+		return actual.(*logFileTable)
+	}
+	actual, loaded := memFileTables.LoadOrStore(db, newLogFileTable())
+	if !loaded {
+		runtime.SetFinalizer(db, func(db *DB) { memFileTables.Delete(db) })
+	}
+	return actual.(*logFileTable)
+}
+
+// open returns a ref-counted handle for candidate.fid: the existing entry with its refcount
+// bumped if one is already registered (candidate is then discarded), or candidate itself,
+// opened via candidate.open(path, flags, opt) and registered, otherwise. The returned error
+// may be z.NewFile, same as (*logFile).open, so callers keep their existing "was this
+// freshly created" check.
+func (t *logFileTable) open(
+	candidate *logFile, path string, flags int, opt Options) (*logFile, error) {
+	t.RLock()
+	lf, ok := t.files[candidate.fid]
+	t.RUnlock()
+	if ok {
+		lf.IncrRef()
+		return lf, nil
+	}
+
+	// Slow path: open and insert under the exclusive lock, so two racing callers for the
+	// same fid can't both end up opening (and bootstrapping) the file.
+	t.Lock()
+	defer t.Unlock()
+	if lf, ok := t.files[candidate.fid]; ok {
+		lf.IncrRef()
+		return lf, nil
+	}
+
+	ferr := candidate.open(path, flags, opt)
+	if ferr != nil && ferr != z.NewFile {
+		return nil, ferr
+	}
+	candidate.table = t
+	candidate.ref = 1
+	t.files[candidate.fid] = candidate
+	return candidate, ferr
+}
+
+// IncrRef bumps lf's reference count. Pair with DecrRef.
+func (lf *logFile) IncrRef() {
+	lf.refMu.Lock()
+	lf.ref++
+	lf.refMu.Unlock()
+}
+
+// DecrRef drops lf's reference count. Once it reaches zero, lf is removed from its table
+// (if any); WAL files additionally delete themselves outright, while other files are left
+// for their owner (e.g. doneWriting, which already waited for the refcount to drain) to
+// unmap and finalize.
+func (lf *logFile) DecrRef() error {
+	lf.refMu.Lock()
+	lf.ref--
+	newRef := lf.ref
+	if lf.refCond != nil {
+		lf.refCond.Broadcast()
+	}
+	lf.refMu.Unlock()
+
+	if newRef > 0 {
+		return nil
+	}
+	if lf.table != nil {
+		lf.table.Lock()
+		delete(lf.table.files, lf.fid)
+		lf.table.Unlock()
+	}
+	if lf.isWAL {
+		return lf.Delete()
+	}
+	return nil
+}
+
+// awaitRefDrain blocks until lf's refcount drops to n. doneWriting uses this to wait for
+// n==1 (its own hold) before it's safe to unmap: every other reader must have released its
+// reference first, which is what used to make unmapping here a segfault risk.
+func (lf *logFile) awaitRefDrain(n int32) {
+	lf.refMu.Lock()
+	if lf.refCond == nil {
+		lf.refCond = sync.NewCond(&lf.refMu)
+	}
+	for lf.ref > n {
+		lf.refCond.Wait()
+	}
+	lf.refMu.Unlock()
+}
+
+// pinForRead bumps lf's refcount for the duration of a read/iterate call, the same
+// bookkeeping logFileTable.open uses for its own hold, so awaitRefDrain(1) in doneWriting
+// actually sees readers in flight instead of just the table's base reference. It's a no-op
+// for a standalone logFile (lf.table == nil, e.g. in tests), which isn't ref-counted at all.
+// Pair with unpinForRead, typically via defer.
+func (lf *logFile) pinForRead() {
+	if lf.table != nil {
+		lf.IncrRef()
+	}
+}
+
+// unpinForRead reverses pinForRead.
+func (lf *logFile) unpinForRead() {
+	if lf.table != nil {
+		_ = lf.DecrRef()
+	}
+}
+
+// readSerializer coordinates concurrent (*logFile).read/readAt calls against one logFile
+// so they execute in roughly ascending offset order, the gocryptfs "serialize_reads" idea
+// applied to vlog/WAL files: on rotational storage, a hot-key iteration or range scan that
+// issues reads out of order turns into head-thrash, where an in-order scan would have been
+// one sequential pass.
+type readSerializer struct {
+	mu sync.Mutex
+	// cond is signalled whenever the pending set changes, so a blocked acquire can
+	// re-check whether it has become the smallest pending offset.
+	cond *sync.Cond
+	// nextOffset tracks the highest offset released so far, purely for observability; the
+	// actual scheduling decision below is based on the pending set, not this field.
+	nextOffset uint32
+	pending    []uint32
+}
+
+func newReadSerializer() *readSerializer {
+	rs := &readSerializer{}
+	rs.cond = sync.NewCond(&rs.mu)
+	return rs
+}
+
+// acquire blocks the caller until offset is the smallest of all currently pending reads,
+// then returns. nextOffset is not consulted, so a read below it is not held back on that
+// account. A nil receiver (serializing disabled, or MemoryMap mode) makes this a no-op.
+func (rs *readSerializer) acquire(offset uint32) {
+	if rs == nil {
+		return
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.pending = append(rs.pending, offset)
+	waited := false
+	for !rs.isSmallestLocked(offset) {
+		waited = true
+		rs.cond.Wait()
+	}
+	if waited {
+		y.NumSerializedReadsWaits.Add(1)
+	}
+}
+
+// isSmallestLocked reports whether offset is the smallest value in the pending set. Ties
+// (multiple reads registered at the same offset) are all considered smallest, since they
+// don't need ordering relative to each other.
+func (rs *readSerializer) isSmallestLocked(offset uint32) bool {
+	for _, o := range rs.pending {
+		if o < offset {
+			return false
+		}
+	}
+	return true
+}
+
+// release removes offset from the pending set, bumps nextOffset, and wakes any readers that
+// might now be eligible to proceed. A nil receiver is a no-op.
+func (rs *readSerializer) release(offset uint32) {
+	if rs == nil {
+		return
+	}
+	rs.mu.Lock()
+	for i, o := range rs.pending {
+		if o == offset {
+			rs.pending = append(rs.pending[:i], rs.pending[i+1:]...)
+			break
+		}
+	}
+	if offset > rs.nextOffset {
+		rs.nextOffset = offset
+	}
+	rs.mu.Unlock()
+	rs.cond.Broadcast()
 }
 
 // encodeEntry will encode entry to the buf
@@ -223,6 +513,17 @@ type logFile struct {
 // +--------+-----+-------+-------+
 // | header | key | value | crc32 |
 // +--------+-----+-------+-------+
+//
+// When the file's algo is an AEAD cipher (aesGCM or chaCha20Poly1305), the layout is
+// instead:
+// +--------+-----------------+
+// | header | key | value | tag |
+// +--------+-----------------+
+// where header is passed as AAD, so it is authenticated but not encrypted, and tag (16
+// bytes) replaces the crc32 trailer.
+//
+// Neither layout applies when encryption is enabled and the file's blockSize is non-zero:
+// such entries are written by encodeChunkedEntry, with no crc32 trailer.
 func (lf *logFile) encodeEntry(buf *bytes.Buffer, e *Entry, offset uint32) (int, error) {
 	h := header{
 		klen:      uint32(len(e.Key)),
@@ -232,12 +533,29 @@ func (lf *logFile) encodeEntry(buf *bytes.Buffer, e *Entry, offset uint32) (int,
 		userMeta:  e.UserMeta,
 	}
 
-	hash := crc32.New(y.CastagnoliCrcTable)
-	writer := io.MultiWriter(buf, hash)
-
 	// encode header.
 	var headerEnc [maxHeaderSize]byte
 	sz := h.Encode(headerEnc[:])
+
+	if lf.encryptionEnabled() && lf.blockSize > 0 {
+		return lf.encodeChunkedEntry(buf, e, headerEnc[:sz], offset)
+	}
+
+	if lf.encryptionEnabled() && lf.algo != aesCTR {
+		y.Check2(buf.Write(headerEnc[:sz]))
+		plain := make([]byte, 0, len(e.Key)+len(e.Value))
+		plain = append(plain, e.Key...)
+		plain = append(plain, e.Value...)
+		sealed, err := lf.seal(plain, headerEnc[:sz], offset)
+		if err != nil {
+			return 0, y.Wrapf(err, "Error while encoding entry for vlog.")
+		}
+		y.Check2(buf.Write(sealed))
+		return sz + len(sealed), nil
+	}
+
+	hash := crc32.New(y.CastagnoliCrcTable)
+	writer := io.MultiWriter(buf, hash)
 	y.Check2(writer.Write(headerEnc[:sz]))
 	// we'll encrypt only key and value.
 	if lf.encryptionEnabled() {
@@ -264,6 +582,133 @@ func (lf *logFile) encodeEntry(buf *bytes.Buffer, e *Entry, offset uint32) (int,
 	return len(headerEnc[:sz]) + len(e.Key) + len(e.Value) + len(crcBuf), nil
 }
 
+// encodeChunkedEntry writes header, then the key as a single encrypted block (keys are
+// expected to stay well under blockSize so chunking them would be pure overhead), followed
+// by the value split into lf.blockSize plaintext blocks. Each block is encrypted/sealed
+// independently, using a nonce/IV derived from baseIV, the entry's record offset and the
+// block's index, so (*logFile).readRange can later decrypt any single block without
+// touching its neighbours.
+func (lf *logFile) encodeChunkedEntry(
+	buf *bytes.Buffer, e *Entry, headerEnc []byte, offset uint32) (int, error) {
+	y.Check2(buf.Write(headerEnc))
+	n := len(headerEnc)
+
+	keyBlock, err := lf.encryptBlock(e.Key, offset, 0)
+	if err != nil {
+		return 0, y.Wrapf(err, "Error while encoding entry for vlog.")
+	}
+	y.Check2(buf.Write(keyBlock))
+	n += len(keyBlock)
+
+	for i, chunk := range splitIntoBlocks(e.Value, lf.blockSize) {
+		// Block index 0 is reserved for the key, so value blocks start at 1.
+		valBlock, err := lf.encryptBlock(chunk, offset, uint32(i+1))
+		if err != nil {
+			return 0, y.Wrapf(err, "Error while encoding entry for vlog.")
+		}
+		y.Check2(buf.Write(valBlock))
+		n += len(valBlock)
+	}
+	return n, nil
+}
+
+// splitIntoBlocks slices plain into contiguous blockSize-sized chunks, the last one
+// possibly shorter. An empty plain yields no blocks.
+func splitIntoBlocks(plain []byte, blockSize uint32) [][]byte {
+	var blocks [][]byte
+	for off := 0; off < len(plain); off += int(blockSize) {
+		end := off + int(blockSize)
+		if end > len(plain) {
+			end = len(plain)
+		}
+		blocks = append(blocks, plain[off:end])
+	}
+	return blocks
+}
+
+// encryptBlock encrypts/seals one block-sized chunk belonging to the entry at
+// entryOffset. blockIdx 0 is reserved for the key; value blocks are numbered from 1.
+func (lf *logFile) encryptBlock(plain []byte, entryOffset, blockIdx uint32) ([]byte, error) {
+	if lf.algo == aesCTR {
+		return y.XORBlockAllocate(plain, lf.dataKey.Data, lf.blockIV(entryOffset, blockIdx))
+	}
+	aead, err := lf.aead()
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, lf.blockNonce(entryOffset, blockIdx), plain, nil), nil
+}
+
+// decryptBlock is the inverse of encryptBlock. An AEAD tag mismatch is reported as
+// errTruncate, same as unseal, so callers treat it like the end of valid data.
+func (lf *logFile) decryptBlock(sealed []byte, entryOffset, blockIdx uint32) ([]byte, error) {
+	if lf.algo == aesCTR {
+		return y.XORBlockAllocate(sealed, lf.dataKey.Data, lf.blockIV(entryOffset, blockIdx))
+	}
+	aead, err := lf.aead()
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, lf.blockNonce(entryOffset, blockIdx), sealed, nil)
+	if err != nil {
+		return nil, errTruncate
+	}
+	return plain, nil
+}
+
+// blockNonce folds a block index into the per-entry AEAD nonce, so each block within the
+// same entry gets a distinct nonce.
+func (lf *logFile) blockNonce(entryOffset, blockIdx uint32) []byte {
+	nonce := lf.generateNonce(entryOffset)
+	var idxBuf [4]byte
+	binary.BigEndian.PutUint32(idxBuf[:], blockIdx)
+	for i, b := range idxBuf {
+		nonce[i] ^= b
+	}
+	return nonce
+}
+
+// blockIV is blockNonce's aesCTR counterpart: a full 16-byte AES-CTR IV with the block
+// index folded into the baseIV bytes the offset doesn't already occupy.
+func (lf *logFile) blockIV(entryOffset, blockIdx uint32) []byte {
+	iv := lf.generateIV(entryOffset)
+	var idxBuf [4]byte
+	binary.BigEndian.PutUint32(idxBuf[:], blockIdx)
+	for i, b := range idxBuf {
+		iv[8+i] ^= b
+	}
+	return iv
+}
+
+// trailerPerBlock returns the per-block authentication tag overhead: aeadTagSize for AEAD
+// algorithms, 0 for aesCTR which has no per-block authentication.
+func (lf *logFile) trailerPerBlock() int {
+	if lf.algo != aesCTR {
+		return aeadTagSize
+	}
+	return 0
+}
+
+// encodedKVLen returns the number of ciphertext bytes that follow the header for a
+// klen/vlen pair, accounting for this file's blockSize and per-block tag overhead.
+func (lf *logFile) encodedKVLen(klen, vlen uint32) int {
+	if lf.blockSize == 0 || !lf.encryptionEnabled() {
+		return int(klen+vlen) + lf.trailerSize()
+	}
+	tag := lf.trailerPerBlock()
+	n := int(klen) + tag
+	remaining := int(vlen)
+	for remaining > 0 {
+		blockLen := int(lf.blockSize)
+		if remaining < blockLen {
+			blockLen = remaining
+		}
+		n += blockLen + tag
+		remaining -= blockLen
+	}
+	return n
+}
+
 func (lf *logFile) writeEntry(buf *bytes.Buffer, e *Entry, opt Options) error {
 	buf.Reset()
 	plen, err := lf.encodeEntry(buf, e, lf.writeAt)
@@ -279,12 +724,34 @@ func (lf *logFile) decodeEntry(buf []byte, offset uint32) (*Entry, error) {
 	var h header
 	hlen := h.Decode(buf)
 	kv := buf[hlen:]
+	if lf.encryptionEnabled() && lf.blockSize > 0 {
+		key, value, err := lf.decodeChunkedKV(kv, h.klen, h.vlen, offset)
+		if err != nil {
+			return nil, err
+		}
+		return &Entry{
+			meta:      h.meta,
+			UserMeta:  h.userMeta,
+			ExpiresAt: h.expiresAt,
+			offset:    offset,
+			Key:       key,
+			Value:     value,
+		}, nil
+	}
 	if lf.encryptionEnabled() {
 		var err error
-		// No need to worry about mmap. because, XORBlock allocates a byte array to do the
-		// xor. So, the given slice is not being mutated.
-		if kv, err = lf.decryptKV(kv, offset); err != nil {
-			return nil, err
+		if lf.algo == aesCTR {
+			// No need to worry about mmap. because, XORBlock allocates a byte array to do the
+			// xor. So, the given slice is not being mutated.
+			if kv, err = lf.decryptKV(kv, offset); err != nil {
+				return nil, err
+			}
+		} else {
+			// buf[:hlen] (the header) was passed as AAD while encoding, so it must be
+			// replayed unchanged here for the tag to verify.
+			if kv, err = lf.unseal(kv, buf[:hlen], offset); err != nil {
+				return nil, err
+			}
 		}
 	}
 	e := &Entry{
@@ -302,6 +769,110 @@ func (lf *logFile) decryptKV(buf []byte, offset uint32) ([]byte, error) {
 	return y.XORBlockAllocate(buf, lf.dataKey.Data, lf.generateIV(offset))
 }
 
+// decodeChunkedKV is the inverse of encodeChunkedEntry: it walks the same key-block,
+// value-blocks layout, decrypting each block in turn and reassembling the plaintext value.
+func (lf *logFile) decodeChunkedKV(buf []byte, klen, vlen uint32, offset uint32) (key, value []byte, err error) {
+	tag := lf.trailerPerBlock()
+
+	keyCipherLen := int(klen) + tag
+	if keyCipherLen > len(buf) {
+		return nil, nil, errTruncate
+	}
+	if key, err = lf.decryptBlock(buf[:keyCipherLen], offset, 0); err != nil {
+		return nil, nil, err
+	}
+	buf = buf[keyCipherLen:]
+
+	value = make([]byte, 0, vlen)
+	var blockIdx uint32 = 1
+	remaining := int(vlen)
+	for remaining > 0 {
+		plainLen := int(lf.blockSize)
+		if remaining < plainLen {
+			plainLen = remaining
+		}
+		cipherLen := plainLen + tag
+		if cipherLen > len(buf) {
+			return nil, nil, errTruncate
+		}
+		chunk, err := lf.decryptBlock(buf[:cipherLen], offset, blockIdx)
+		if err != nil {
+			return nil, nil, err
+		}
+		value = append(value, chunk...)
+		buf = buf[cipherLen:]
+		remaining -= plainLen
+		blockIdx++
+	}
+	return key, value, nil
+}
+
+// seal encrypts plain with the logFile's AEAD cipher, authenticating aad (the entry's
+// header bytes) alongside it. The returned slice is ciphertext||tag.
+func (lf *logFile) seal(plain, aad []byte, offset uint32) ([]byte, error) {
+	aead, err := lf.aead()
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, lf.generateNonce(offset), plain, aad), nil
+}
+
+// unseal is the inverse of seal. A tag-verification failure is reported as errTruncate, so
+// callers treat it exactly like the CRC mismatch it replaces: the rest of the file is
+// considered corrupt/unwritten and iteration stops there.
+func (lf *logFile) unseal(sealed, aad []byte, offset uint32) ([]byte, error) {
+	aead, err := lf.aead()
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, lf.generateNonce(offset), sealed, aad)
+	if err != nil {
+		return nil, errTruncate
+	}
+	return plain, nil
+}
+
+// aead builds the AEAD cipher for lf.algo over lf.dataKey. It is cheap enough to build
+// per-entry; cipher.NewGCM / chacha20poly1305.New construction mostly validates the key size.
+func (lf *logFile) aead() (cipher.AEAD, error) {
+	switch lf.algo {
+	case aesGCM:
+		block, err := aes.NewCipher(lf.dataKey.Data)
+		if err != nil {
+			return nil, y.Wrapf(err, "Error while creating AES cipher for vlog")
+		}
+		return cipher.NewGCM(block)
+	case chaCha20Poly1305:
+		return chacha20poly1305.New(lf.dataKey.Data)
+	default:
+		return nil, errors.Errorf("logFile %d: unsupported AEAD algorithm %d", lf.fid, lf.algo)
+	}
+}
+
+// generateNonce derives a 12-byte AEAD nonce from the logFile's baseIV and the record's
+// offset, the same way generateIV derives an AES-CTR IV. The offset is XORed into the last
+// four bytes of baseIV rather than appended, since AEAD nonces here are 12 bytes, not the
+// 16-byte AES block size generateIV produces.
+func (lf *logFile) generateNonce(offset uint32) []byte {
+	nonce := make([]byte, 12)
+	y.AssertTrue(12 == copy(nonce, lf.baseIV))
+	var offBuf [4]byte
+	binary.BigEndian.PutUint32(offBuf[:], offset)
+	for i, b := range offBuf {
+		nonce[8+i] ^= b
+	}
+	return nonce
+}
+
+// trailerSize returns the number of bytes that trail an encoded key||value: a crc32
+// checksum for plaintext and aesCTR entries, or an AEAD tag otherwise.
+func (lf *logFile) trailerSize() int {
+	if lf.encryptionEnabled() && lf.algo != aesCTR {
+		return aeadTagSize
+	}
+	return crc32.Size
+}
+
 // KeyID returns datakey's ID.
 func (lf *logFile) keyID() uint64 {
 	if lf.dataKey == nil {
@@ -350,8 +921,12 @@ func (lf *logFile) munmap() (err error) {
 
 // Acquire lock on mmap/file if you are calling this
 func (lf *logFile) read(p valuePointer, s *y.Slice) (buf []byte, err error) {
+	lf.pinForRead()
+	defer lf.unpinForRead()
 	var nbr int64
 	offset := p.Offset
+	lf.serializer.acquire(offset)
+	defer lf.serializer.release(offset)
 	if lf.loadingMode == options.FileIO {
 		buf = s.Resize(int(p.Len))
 		var n int
@@ -380,6 +955,105 @@ func (lf *logFile) read(p valuePointer, s *y.Slice) (buf []byte, err error) {
 	return buf, err
 }
 
+// readAt reads exactly n bytes starting at offset, picking the mmap'd Data slice or a
+// direct pread depending on the file's loading mode, the same split as read.
+func (lf *logFile) readAt(offset uint32, n int) ([]byte, error) {
+	lf.pinForRead()
+	defer lf.unpinForRead()
+	lf.serializer.acquire(offset)
+	defer lf.serializer.release(offset)
+	if lf.loadingMode == options.FileIO {
+		buf := make([]byte, n)
+		nbr, err := lf.Fd.ReadAt(buf, int64(offset))
+		y.NumReads.Add(1)
+		y.NumBytesRead.Add(int64(nbr))
+		return buf, err
+	}
+	size := int64(len(lf.Data))
+	if int64(offset)+int64(n) > size || int64(offset)+int64(n) > int64(atomic.LoadUint32(&lf.size)) {
+		return nil, y.ErrEOF
+	}
+	y.NumReads.Add(1)
+	y.NumBytesRead.Add(int64(n))
+	return lf.Data[offset : int64(offset)+int64(n)], nil
+}
+
+// readRange returns the plaintext bytes [off, off+n) of the value stored at p, decrypting
+// only the blocks that cover the requested range instead of the whole value. It requires an
+// encrypted, chunked (encryptionEnabled() && blockSize > 0) entry -- the same condition
+// encodeEntry/decodeEntry use to decide whether an entry was chunked -- since a plaintext
+// entry with blockSize set was still written via the flat, unchunked path. Values written
+// before chunking was enabled have no independently-decryptable blocks either and must go
+// through read + decodeEntry instead.
+//
+// This is the logFile-level primitive a DB/Txn-facing streaming-read API would sit on top
+// of, resolving a key's valuePointer down to the logFile and delegating here.
+// Acquire lf.lock (shared) before calling, same as read.
+func (lf *logFile) readRange(p valuePointer, off, n int64) ([]byte, error) {
+	if !lf.encryptionEnabled() || lf.blockSize == 0 {
+		return nil, errors.Errorf(
+			"logFile %d: readRange requires a chunked entry (blockSize>0)", lf.fid)
+	}
+	if off < 0 || n < 0 {
+		return nil, errors.Errorf("logFile %d: invalid range [%d, %d)", lf.fid, off, off+n)
+	}
+
+	// Pin for the whole operation, not just each inner readAt: otherwise the gap between the
+	// header readAt and the block-data readAt below is unprotected against a concurrent unmap.
+	lf.pinForRead()
+	defer lf.unpinForRead()
+
+	hdrBuf, err := lf.readAt(p.Offset, maxHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+	var h header
+	hlen := h.Decode(hdrBuf)
+
+	if off+n > int64(h.vlen) {
+		return nil, errors.Errorf(
+			"logFile %d: range [%d, %d) exceeds value length %d", lf.fid, off, off+n, h.vlen)
+	}
+
+	tag := lf.trailerPerBlock()
+	blockSize := int64(lf.blockSize)
+	stride := blockSize + int64(tag)
+	valueStart := p.Offset + uint32(hlen) + uint32(int64(h.klen)+int64(tag))
+
+	firstBlock := off / blockSize
+	lastBlock := (off + n - 1) / blockSize
+	readFrom := valueStart + uint32(firstBlock*stride)
+	// The value's last block may be shorter than blockSize; read only what was written.
+	lastPlain := int64(h.vlen) - lastBlock*blockSize
+	if lastPlain > blockSize {
+		lastPlain = blockSize
+	}
+	readLen := int((lastBlock-firstBlock)*stride + lastPlain + int64(tag))
+
+	cipher, err := lf.readAt(readFrom, readLen)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, n)
+	for b := firstBlock; b <= lastBlock; b++ {
+		plainLen := blockSize
+		if remaining := int64(h.vlen) - b*blockSize; remaining < plainLen {
+			plainLen = remaining
+		}
+		cipherLen := int(plainLen) + tag
+		plain, err := lf.decryptBlock(cipher[:cipherLen], p.Offset, uint32(b+1))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, plain...)
+		cipher = cipher[cipherLen:]
+	}
+
+	lo := off - firstBlock*blockSize
+	return out[lo : lo+n], nil
+}
+
 // generateIV will generate IV by appending given offset with the base IV.
 func (lf *logFile) generateIV(offset uint32) []byte {
 	iv := make([]byte, aes.BlockSize)
@@ -390,16 +1064,19 @@ func (lf *logFile) generateIV(offset uint32) []byte {
 	return iv
 }
 
+// doneWriting finalizes a logFile that's done being appended to: it unmaps, truncates to
+// offset and remaps it. The caller must be holding its own reference to lf (e.g. via the
+// logFileTable); doneWriting waits for every other reference to drain before touching the
+// mapping, which is what makes the unmap below safe instead of a segfault race against a
+// concurrent reader.
 func (lf *logFile) doneWriting(offset uint32) error {
 	// Just always sync on rotate.
 	if err := z.Msync(lf.Data); err != nil {
 		return errors.Wrapf(err, "Unable to sync value log: %q", lf.path)
 	}
 
-	// Before we were acquiring a lock here on lf.lock, because we were invalidating the file
-	// descriptor due to reopening it as read-only. Now, we don't invalidate the fd, but unmap it,
-	// truncate it and remap it. That creates a window where we have segfaults because the mmap is
-	// no longer valid, while someone might be reading it. Therefore, we need a lock here again.
+	lf.awaitRefDrain(1)
+
 	lf.lock.Lock()
 	defer lf.lock.Unlock()
 
@@ -408,7 +1085,6 @@ func (lf *logFile) doneWriting(offset uint32) error {
 		return errors.Wrapf(err, "failed to munmap vlog file %s", lf.Fd.Name())
 	}
 
-	// TODO: Confirm if we need to run a file sync after truncation.
 	// Truncation must run after unmapping, otherwise Windows would crap itself.
 	if err := lf.Fd.Truncate(int64(offset)); err != nil {
 		return errors.Wrapf(err, "Unable to truncate file: %q", lf.path)
@@ -432,9 +1108,13 @@ func (lf *logFile) sync() error {
 // iterate iterates over log file. It doesn't not allocate new memory for every kv pair.
 // Therefore, the kv pair is only valid for the duration of fn call.
 func (lf *logFile) iterate(readOnly bool, offset uint32, fn logEntry) (uint32, error) {
+	lf.pinForRead()
+	defer lf.unpinForRead()
 	if offset == 0 {
-		// If offset is set to zero, let's advance past the encryption key header.
-		offset = vlogHeaderSize
+		// If offset is set to zero, let's advance past this file's actual header -- which,
+		// for a file bootstrapped before algo/blockSize existed, is legacyVlogHeaderSize, not
+		// vlogHeaderSize; see (*logFile).open.
+		offset = lf.headerSize
 	}
 	// TODO: Don't know what the end of file is. We just have to read it to know it.
 	// if readOnly {
@@ -476,7 +1156,7 @@ loop:
 		}
 
 		var vp valuePointer
-		vp.Len = uint32(int(e.hlen) + len(e.Key) + len(e.Value) + crc32.Size)
+		vp.Len = uint32(int(e.hlen) + lf.encodedKVLen(uint32(len(e.Key)), uint32(len(e.Value))))
 		read.recordOffset += vp.Len
 
 		vp.Offset = e.offset
@@ -538,14 +1218,31 @@ func (lf *logFile) open(path string, flags int, opt Options) error {
 	mf, ferr := z.OpenMmapFile(path, flags, 2*int(opt.ValueLogFileSize))
 	lf.MmapFile = mf
 	if ferr == z.NewFile {
-		if err := lf.bootstrap(); err != nil {
+		if err := lf.bootstrap(opt); err != nil {
 			os.Remove(path)
 			return err
 		}
+		// bootstrap just wrote the current, extended header itself; there's nothing to
+		// detect, unlike the reopen path below.
+		lf.headerSize = vlogHeaderSize
 	} else if ferr != nil {
 		return errors.Wrapf(ferr, "while opening file: %s", path)
 	}
 
+	// Serializing reads only helps in FileIO mode, where every read really does seek; under
+	// MemoryMap it would just add latency for no benefit, so leave lf.serializer nil there.
+	// WAL and vlog files are gated on separate options since operators may only want ordered
+	// reads on one of the two.
+	if lf.loadingMode == options.FileIO {
+		serialize := opt.SerializeVlogReads
+		if lf.isWAL {
+			serialize = opt.SerializeWALReads
+		}
+		if serialize {
+			lf.serializer = newReadSerializer()
+		}
+	}
+
 	// if sz < vlogHeaderSize {
 	// 	// Every vlog file should have at least vlogHeaderSize. If it is less than vlogHeaderSize
 	// 	// then it must have been corrupted. But no need to handle here. log replayer will truncate
@@ -553,10 +1250,11 @@ func (lf *logFile) open(path string, flags int, opt Options) error {
 	// 	return nil
 	// }
 
-	// Copy over the encryption registry data.
-	buf := make([]byte, vlogHeaderSize)
-
-	y.AssertTrue(vlogHeaderSize == copy(buf, lf.Data))
+	// keyID and baseIV sit at the same offset under both the legacy and extended layouts, so
+	// these are always safe to read back, whether this file was just bootstrapped above or is
+	// being reopened.
+	buf := make([]byte, legacyVlogHeaderSize)
+	y.AssertTrue(legacyVlogHeaderSize == copy(buf, lf.Data))
 	keyID := binary.BigEndian.Uint64(buf[:8])
 	// retrieve datakey.
 	if dk, err := lf.registry.dataKey(keyID); err != nil {
@@ -564,19 +1262,46 @@ func (lf *logFile) open(path string, flags int, opt Options) error {
 	} else {
 		lf.dataKey = dk
 	}
-	lf.baseIV = buf[8:]
+	lf.baseIV = buf[8:20]
 	y.AssertTrue(len(lf.baseIV) == 12)
 
+	if ferr == z.NewFile {
+		// bootstrap already set lf.algo/lf.blockSize correctly; nothing left to infer.
+		return ferr
+	}
+
+	// Reopening an existing file: algo/blockSize only exist under the extended header, and
+	// only a file actually bootstrapped with them has vlogHeaderMagic at this offset -- a file
+	// written before they existed has its first entry start right here instead. Trust them
+	// only when the magic confirms it; otherwise assume the legacy header every release
+	// before this one wrote (plain aesCTR, unchunked), which is also the right answer for
+	// plaintext files, since keyID==0 already makes algo/blockSize meaningless for them.
+	lf.headerSize = legacyVlogHeaderSize
+	lf.algo = aesCTR
+	lf.blockSize = 0
+	if lf.encryptionEnabled() && len(lf.Data) >= vlogHeaderSize {
+		ext := lf.Data[legacyVlogHeaderSize:vlogHeaderSize]
+		if binary.BigEndian.Uint32(ext[:4]) == vlogHeaderMagic {
+			lf.algo = encAlgo(ext[4])
+			lf.blockSize = binary.BigEndian.Uint32(ext[5:9])
+			lf.headerSize = vlogHeaderSize
+		}
+	}
+
 	// Preserved ferr so we can return if this was a new file.
 	return ferr
 }
 
-// bootstrap will initialize the log file with key id and baseIV.
-// The below figure shows the layout of log file.
-// +----------------+------------------+------------------+
-// | keyID(8 bytes) |  baseIV(12 bytes)|	 entry...     |
-// +----------------+------------------+------------------+
-func (lf *logFile) bootstrap() error {
+// bootstrap will initialize the log file with key id, baseIV, a format marker, the
+// entry-encryption algorithm and the value block size. The below figure shows the layout.
+// +----------------+-------------------+----------------+--------------+--------------------+-----------+
+// | keyID(8 bytes) | baseIV(12 bytes)  | magic(4 bytes) | algo(1 byte) | blockSize(4 bytes) | entry... |
+// +----------------+-------------------+----------------+--------------+--------------------+-----------+
+// magic is vlogHeaderMagic: it's what lets (*logFile).open tell this layout apart from the
+// legacy keyID+baseIV-only header (legacyVlogHeaderSize) written by every release before this
+// one, whose first entry starts at the same offset magic/algo/blockSize occupy here. Without
+// it, reopening an old encrypted file would misread that entry's bytes as algo/blockSize.
+func (lf *logFile) bootstrap(opt Options) error {
 	var err error
 
 	// generate data key for the log file.
@@ -585,20 +1310,25 @@ func (lf *logFile) bootstrap() error {
 		return y.Wrapf(err, "Error while retrieving datakey in logFile.bootstarp")
 	}
 	lf.dataKey = dk
+	lf.algo = opt.EntryEncryptionAlgo
+	lf.blockSize = opt.ValueBlockSize
 
-	// We'll always preserve vlogHeaderSize for key id and baseIV.
+	// We'll always preserve vlogHeaderSize for key id, baseIV, magic, algo and blockSize.
 	buf := make([]byte, vlogHeaderSize)
 
 	// write key id to the buf.
 	// key id will be zero if the logfile is in plain text.
 	binary.BigEndian.PutUint64(buf[:8], lf.keyID())
 	// generate base IV. It'll be used with offset of the vptr to encrypt the entry.
-	if _, err := cryptorand.Read(buf[8:]); err != nil {
+	if _, err := cryptorand.Read(buf[8:20]); err != nil {
 		return y.Wrapf(err, "Error while creating base IV, while creating logfile")
 	}
+	binary.BigEndian.PutUint32(buf[20:24], vlogHeaderMagic)
+	buf[24] = byte(lf.algo)
+	binary.BigEndian.PutUint32(buf[25:29], lf.blockSize)
 
 	// Initialize base IV.
-	lf.baseIV = buf[8:]
+	lf.baseIV = buf[8:20]
 	y.AssertTrue(len(lf.baseIV) == 12)
 
 	// Copy over to the logFile.
@@ -611,6 +1341,6 @@ func (lf *logFile) reset() {
 	if lf == nil {
 		return
 	}
-	z.ZeroOut(lf.Data, vlogHeaderSize, int(lf.writeAt))
-	lf.writeAt = vlogHeaderSize
+	z.ZeroOut(lf.Data, int(lf.headerSize), int(lf.writeAt))
+	lf.writeAt = lf.headerSize
 }